@@ -11,6 +11,7 @@ import (
 	"github.com/golang/glog"
 	"github.com/google/mtail/metrics"
 	"github.com/google/mtail/metrics/datum"
+	"github.com/google/mtail/vm/ssa"
 	"github.com/pkg/errors"
 )
 
@@ -22,30 +23,119 @@ type codegen struct {
 	obj    object    // The object to return
 
 	decos []*decoNode // Decorator stack to unwind
+
+	f     *ssa.Func    // SSA form of the program being built
+	cur   *ssa.Block   // Block currently being appended to
+	stack []*ssa.Value // Values produced so far, in stack-machine order
+
+	lastCond *ssa.Value // condition Value produced by the walk just completed, for buildCond
 }
 
 // CodeGen is the function that compiles the program to bytecode and data.
+// It lowers the AST to the SSA form defined in vm/ssa, runs DefaultPipeline
+// over it, and lowers the result to the instr stream that the VM executes.
 func CodeGen(name string, ast astNode) (*object, error) {
-	c := &codegen{name: name}
+	ast = FoldConstants(ast)
+	c := &codegen{name: name, f: ssa.NewFunc(name)}
+	c.cur = c.f.Entry
 	Walk(c, ast)
 	if len(c.errors) > 0 {
 		return nil, c.errors
 	}
+	c.f.LinkPreds()
+	DefaultPipeline.Run(c.f)
+	c.lower()
+	eliminateDeadCode(&c.obj)
+	peepholeOptimize(&c.obj)
 	return &c.obj, nil
 }
 
+// DefaultPipeline is the sequence of ssa.Passes CodeGen runs over the SSA
+// form of a program before lowering it to bytecode.  ssa.DeadBlocks always
+// runs first, since lower() depends on it to lay out c.f.Blocks in an
+// order where a condNode's merge Block can't alias with an arm created
+// after it; further optimization passes register themselves here as they
+// land.
+var DefaultPipeline = ssa.Pipeline{ssa.DeadBlocks{}}
+
 func (c *codegen) errorf(pos *position, format string, args ...interface{}) {
 	e := "Internal compiler error, aborting compilation: " + fmt.Sprintf(format, args...)
 	c.errors.Add(pos, e)
 }
 
-func (c *codegen) emit(i instr) {
-	c.obj.prog = append(c.obj.prog, i)
+// instrAux is the payload every SSA Value built by this file carries: the
+// bytecode opcode and operand it lowers to, plus, for the handful of
+// comparison ops whose "matched" flag is the negation of the source
+// condition (LE, GE, NE), whether a branch on this Value should use jm
+// instead of jnm.
+type instrAux struct {
+	op     opcode
+	opnd   interface{}
+	invert bool
 }
 
-// pc returns the program offset of the last instruction
-func (c *codegen) pc() int {
-	return len(c.obj.prog) - 1
+const valOp ssa.Op = "instr"
+
+// emitV appends a Value to the current block that lowers to a single
+// instr, and returns it.
+func (c *codegen) emitV(aux instrAux, args ...*ssa.Value) *ssa.Value {
+	return c.cur.NewValue(valOp, aux, args...)
+}
+
+func (c *codegen) push(v *ssa.Value) { c.stack = append(c.stack, v) }
+
+func (c *codegen) pop() *ssa.Value {
+	n := len(c.stack) - 1
+	v := c.stack[n]
+	c.stack = c.stack[:n]
+	return v
+}
+
+// popN pops the last n Values off the stack, returning them in the order
+// they were pushed.
+func (c *codegen) popN(n int) []*ssa.Value {
+	if n == 0 {
+		return nil
+	}
+	out := make([]*ssa.Value, n)
+	copy(out, c.stack[len(c.stack)-n:])
+	c.stack = c.stack[:len(c.stack)-n]
+	return out
+}
+
+// buildCond lowers a condNode's condition expression into the current
+// block's control flow, branching to trueB when it holds and falseB
+// otherwise.  AND and OR are handled here directly, by threading in the
+// Blocks that should run next, rather than by patching jump operands once
+// both sides have been visited.
+func (c *codegen) buildCond(n astNode, trueB, falseB *ssa.Block) {
+	if b, ok := n.(*binaryExprNode); ok {
+		switch b.op {
+		case AND:
+			mid := c.f.NewBlock("and.rhs")
+			c.buildCond(b.lhs, mid, falseB)
+			c.cur = mid
+			c.buildCond(b.rhs, trueB, falseB)
+			return
+		case OR:
+			mid := c.f.NewBlock("or.rhs")
+			c.buildCond(b.lhs, trueB, mid)
+			c.cur = mid
+			c.buildCond(b.rhs, trueB, falseB)
+			return
+		}
+	}
+	// A leaf condition: walk it normally so regexNode, otherwiseNode and
+	// relational binaryExprNodes build their comparison Value and record
+	// it in c.lastCond.
+	Walk(c, n)
+	cond := c.lastCond
+	c.lastCond = nil
+	if cond == nil {
+		c.errorf(n.Pos(), "internal error: condition %#v produced no value", n)
+		return
+	}
+	c.cur.Term = ssa.Term{Kind: ssa.TermBranch, Cond: cond, Then: trueB, Else: falseB}
 }
 
 func (c *codegen) VisitBefore(node astNode) Visitor {
@@ -100,31 +190,44 @@ func (c *codegen) VisitBefore(node astNode) Visitor {
 		return nil
 
 	case *condNode:
+		if n.cond == nil && n.fromElse {
+			// FoldConstants determined this condNode's condition is always
+			// false at compile time, so n.truthNode holds what was
+			// originally the else arm (or an empty body, if there wasn't
+			// one). Either way it must run exactly as a live else arm
+			// does: inline in the current block, with no setmatched
+			// bracketing, rather than through the truth arm below, which
+			// always brackets its body in setmatched(false)/setmatched(true)
+			// regardless of whether it's reached unconditionally.
+			Walk(c, n.truthNode)
+			return nil
+		}
+		truthB := c.f.NewBlock("truth")
+		mergeB := c.f.NewBlock("endif")
+		falseTarget := mergeB
+		var elseB *ssa.Block
+		if n.elseNode != nil {
+			elseB = c.f.NewBlock("else")
+			falseTarget = elseB
+		}
 		if n.cond != nil {
-			Walk(c, n.cond)
+			c.buildCond(n.cond, truthB, falseTarget)
+		} else {
+			c.cur.Term = ssa.Term{Kind: ssa.TermJump, Then: truthB}
 		}
-		// Save PC of previous jump instruction emitted by the n.cond
-		// compilation.  (See regexNode and relNode cases, which will emit a
-		// jump as the last instr.)  This jump will skip over the truthNode.
-		pc := c.pc()
 		// Set matched flag false for children.
-		c.emit(instr{setmatched, false})
+		c.cur = truthB
+		c.emitV(instrAux{op: setmatched, opnd: false})
 		Walk(c, n.truthNode)
 		// Re-set matched flag to true for rest of current block.
-		c.emit(instr{setmatched, true})
-		// Rewrite n.cond's jump target to jump to instruction after block.
-		c.obj.prog[pc].opnd = c.pc() + 1
-		// Now also emit the else clause, and a jump.
-		if n.elseNode != nil {
-			c.emit(instr{op: jmp})
-			// Rewrite jump again to avoid this else-skipper just emitted.
-			c.obj.prog[pc].opnd = c.pc() + 1
-			// Now get the PC of the else-skipper just emitted.
-			pc = c.pc()
+		c.emitV(instrAux{op: setmatched, opnd: true})
+		c.cur.Term = ssa.Term{Kind: ssa.TermJump, Then: mergeB}
+		if elseB != nil {
+			c.cur = elseB
 			Walk(c, n.elseNode)
-			// Rewrite else-skipper to the next PC.
-			c.obj.prog[pc].opnd = c.pc() + 1
+			c.cur.Term = ssa.Term{Kind: ssa.TermJump, Then: mergeB}
 		}
+		c.cur = mergeB
 		return nil
 
 	case *regexNode:
@@ -136,27 +239,27 @@ func (c *codegen) VisitBefore(node astNode) Visitor {
 		c.obj.re = append(c.obj.re, re)
 		// Store the location of this regular expression in the regexNode
 		n.addr = len(c.obj.re) - 1
-		c.emit(instr{match, n.addr})
-		c.emit(instr{op: jnm})
+		c.lastCond = c.emitV(instrAux{op: match, opnd: n.addr})
 
 	case *stringConstNode:
 		c.obj.str = append(c.obj.str, n.text)
-		c.emit(instr{str, len(c.obj.str) - 1})
+		c.push(c.emitV(instrAux{op: str, opnd: len(c.obj.str) - 1}))
 
 	case *intConstNode:
-		c.emit(instr{push, n.i})
+		c.push(c.emitV(instrAux{op: push, opnd: n.i}))
 
 	case *floatConstNode:
-		c.emit(instr{push, n.f})
+		c.push(c.emitV(instrAux{op: push, opnd: n.f}))
 
 	case *idNode:
 		if n.sym == nil || n.sym.Binding == nil {
 			c.errorf(n.Pos(), "No metric bound to identifier %q", n.name)
 			return nil
 		}
-		c.emit(instr{mload, n.sym.Addr})
 		m := n.sym.Binding.(*metrics.Metric)
-		c.emit(instr{dload, len(m.Keys)})
+		mload := c.emitV(instrAux{op: mload, opnd: n.sym.Addr})
+		args := append(c.popN(len(m.Keys)), mload)
+		c.push(c.emitV(instrAux{op: dload, opnd: len(m.Keys)}, args...))
 
 	case *caprefNode:
 		if n.sym == nil || n.sym.Binding == nil {
@@ -166,9 +269,9 @@ func (c *codegen) VisitBefore(node astNode) Visitor {
 		rn := n.sym.Binding.(*regexNode)
 		// rn.addr contains the index of the regular expression object,
 		// which correlates to storage on the re slice
-		c.emit(instr{push, rn.addr})
+		pushed := c.emitV(instrAux{op: push, opnd: rn.addr})
 		// n.sym.addr is the capture group offset
-		c.emit(instr{capref, n.sym.Addr})
+		c.push(c.emitV(instrAux{op: capref, opnd: n.sym.Addr}, pushed))
 
 	case *defNode:
 		// Do nothing, defs are inlined.
@@ -193,44 +296,19 @@ func (c *codegen) VisitBefore(node astNode) Visitor {
 		return nil
 
 	case *otherwiseNode:
-		c.emit(instr{op: otherwise})
-		c.emit(instr{op: jnm})
+		c.lastCond = c.emitV(instrAux{op: otherwise})
 
 	case *delNode:
 		Walk(c, n.n)
-		// overwrite the dload instruction
-		pc := c.pc()
-		c.obj.prog[pc].op = del
+		// Retag the load this just built as a delete, instead of
+		// overwriting a raw instr in place.
+		v := c.pop()
+		aux := v.Aux.(instrAux)
+		aux.op = del
+		v.Aux = aux
 
 	case *binaryExprNode:
 		switch n.op {
-		case AND:
-			Walk(c, n.lhs)
-			// pc is jump from first comparison, triggered if this expression is false
-			pc1 := c.pc()
-			Walk(c, n.rhs)
-			pc2 := c.pc()
-			// bounce through the second and leave it there for the condNode containing to overwrite
-			c.obj.prog[pc1].opnd = pc2
-			return nil
-
-		case OR:
-			Walk(c, n.lhs)
-			// pc1 is the jump from first comparison, triggered if false, but we want to jump if true to the block
-			pc1 := c.pc()
-			Walk(c, n.rhs)
-			pc2 := c.pc()
-			// condNode is going to insert a setmatched instruction next, then the block
-			blockPc := pc2 + 2
-			c.obj.prog[pc1].opnd = blockPc
-			switch c.obj.prog[pc1].op {
-			case jnm:
-				c.obj.prog[pc1].op = jm
-			case jm:
-				c.obj.prog[pc1].op = jnm
-			}
-			return nil
-
 		case ADD_ASSIGN:
 			if Equals(n.Type(), Float) {
 				// Double-emit the lhs so that it can be assigned to
@@ -288,46 +366,41 @@ func (c *codegen) VisitAfter(node astNode) {
 			}
 
 		default:
-			c.emit(instr{builtin[n.name], arglen})
+			args := c.popN(arglen)
+			c.push(c.emitV(instrAux{op: builtin[n.name], opnd: arglen}, args...))
 		}
 	case *unaryExprNode:
 		switch n.op {
 		case INC:
-			c.emit(instr{op: inc})
+			c.emitV(instrAux{op: inc}, c.pop())
 		case NOT:
-			c.emit(instr{op: not})
+			c.push(c.emitV(instrAux{op: not}, c.pop()))
 		}
 	case *binaryExprNode:
 		switch n.op {
 		case LT:
-			c.emit(instr{cmp, -1})
-			c.emit(instr{op: jnm})
+			c.lastCond = c.emitV(instrAux{op: cmp, opnd: -1}, c.popN(2)...)
 		case GT:
-			c.emit(instr{cmp, 1})
-			c.emit(instr{op: jnm})
+			c.lastCond = c.emitV(instrAux{op: cmp, opnd: 1}, c.popN(2)...)
 		case LE:
-			c.emit(instr{cmp, 1})
-			c.emit(instr{op: jm})
+			c.lastCond = c.emitV(instrAux{op: cmp, opnd: 1, invert: true}, c.popN(2)...)
 		case GE:
-			c.emit(instr{cmp, -1})
-			c.emit(instr{op: jm})
+			c.lastCond = c.emitV(instrAux{op: cmp, opnd: -1, invert: true}, c.popN(2)...)
 		case EQ:
-			c.emit(instr{cmp, 0})
-			c.emit(instr{op: jnm})
+			c.lastCond = c.emitV(instrAux{op: cmp, opnd: 0}, c.popN(2)...)
 		case NE:
-			c.emit(instr{cmp, 0})
-			c.emit(instr{op: jm})
+			c.lastCond = c.emitV(instrAux{op: cmp, opnd: 0, invert: true}, c.popN(2)...)
 		case ADD_ASSIGN:
 			// When operand is not nil, inc pops the delta from the stack.
 			// TODO(jaq): string concatenation, once datums can hold strings.
 			switch {
 			case Equals(n.Type(), Int):
-				c.emit(instr{inc, 0})
+				c.emitV(instrAux{op: inc, opnd: 0}, c.popN(2)...)
 			case Equals(n.Type(), Float):
 				// Already walked the lhs and rhs of this expression
-				c.emit(instr{fadd, nil})
-				// And a second lhs
-				c.emit(instr{fset, nil})
+				add := c.emitV(instrAux{op: fadd}, c.popN(2)...)
+				// And a second lhs, still under the add's operands on the stack
+				c.emitV(instrAux{op: fset}, c.pop(), add)
 			default:
 				c.errorf(n.Pos(), "Internal error: invalid type for add-assignment: %v", n.op)
 				return
@@ -338,10 +411,11 @@ func (c *codegen) VisitAfter(node astNode) {
 				c.errorf(n.Pos(), "Internal error: no typed operator for binary expression %v", n.op)
 				return
 			}
+			var opc opcode
 			emitflag := false
-			for t, opcode := range opmap {
+			for t, o := range opmap {
 				if Equals(n.Type(), t) {
-					c.emit(instr{op: opcode})
+					opc = o
 					emitflag = true
 					break
 				}
@@ -350,16 +424,17 @@ func (c *codegen) VisitAfter(node astNode) {
 				c.errorf(n.Pos(), "Invalid type for binary expression: %v", n.Type())
 				return
 			}
+			c.push(c.emitV(instrAux{op: opc}, c.popN(2)...))
 		case BITAND:
-			c.emit(instr{op: and})
+			c.push(c.emitV(instrAux{op: and}, c.popN(2)...))
 		case BITOR:
-			c.emit(instr{op: or})
+			c.push(c.emitV(instrAux{op: or}, c.popN(2)...))
 		case XOR:
-			c.emit(instr{op: xor})
+			c.push(c.emitV(instrAux{op: xor}, c.popN(2)...))
 		case SHL:
-			c.emit(instr{op: shl})
+			c.push(c.emitV(instrAux{op: shl}, c.popN(2)...))
 		case SHR:
-			c.emit(instr{op: shr})
+			c.push(c.emitV(instrAux{op: shr}, c.popN(2)...))
 		}
 
 	case *convNode:
@@ -372,18 +447,21 @@ func (c *codegen) VisitAfter(node astNode) {
 
 func (c *codegen) emitConversion(inType, outType Type) error {
 	glog.Infof("Conversion: %q to %q", inType, outType)
-	if Equals(Int, inType) && Equals(Float, outType) {
-		c.emit(instr{op: i2f})
-	} else if Equals(String, inType) && Equals(Float, outType) {
-		c.emit(instr{op: s2f})
-	} else if Equals(String, inType) && Equals(Int, outType) {
-		c.emit(instr{op: s2i})
-	} else if Equals(Float, inType) && Equals(String, outType) {
-		c.emit(instr{op: f2s})
-	} else if Equals(Int, inType) && Equals(String, outType) {
-		c.emit(instr{op: i2s})
-	} else {
+	var convOp opcode
+	switch {
+	case Equals(Int, inType) && Equals(Float, outType):
+		convOp = i2f
+	case Equals(String, inType) && Equals(Float, outType):
+		convOp = s2f
+	case Equals(String, inType) && Equals(Int, outType):
+		convOp = s2i
+	case Equals(Float, inType) && Equals(String, outType):
+		convOp = f2s
+	case Equals(Int, inType) && Equals(String, outType):
+		convOp = i2s
+	default:
 		return errors.Errorf("can't convert %q to %q", inType, outType)
 	}
+	c.push(c.emitV(instrAux{op: convOp}, c.pop()))
 	return nil
 }
@@ -0,0 +1,208 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// countOp returns how many instrs in prog carry the given opcode.
+func countOp(prog []instr, op opcode) int {
+	n := 0
+	for _, i := range prog {
+		if i.op == op {
+			n++
+		}
+	}
+	return n
+}
+
+// assertNoSelfJump fails t if any jmp/jm/jnm in prog targets its own PC.
+// That's the signature of the block-layout bug fixed alongside this test:
+// an empty merge Block laid out between a condNode's two arms aliased its
+// start PC with whichever arm came right after it, turning that arm's own
+// jump back to the merge point into an infinite loop.
+func assertNoSelfJump(t *testing.T, prog []instr) {
+	t.Helper()
+	for pc, i := range prog {
+		switch i.op {
+		case jmp, jm, jnm:
+			if target, ok := i.opnd.(int); ok && target == pc {
+				t.Errorf("instr at pc %d jumps to itself: %v", pc, prog)
+			}
+		}
+	}
+}
+
+// TestCodeGenRepeatedUse guards against the SSA builder silently dropping an
+// instruction for a value that's consumed more than once, as happened when
+// Block.NewValue value-numbered "pure" ops across the whole Func: a second
+// mload/push for the same metric or regex never made it into obj.prog, and
+// the VM's stack machine underflowed at runtime instead of seeing two loads.
+func TestCodeGenRepeatedUse(t *testing.T) {
+	ast, err := Parse("repeated use", strings.NewReader("counter x\n/$/ {\n  x = x + x\n}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := CodeGen("repeated use", ast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// `x` is loaded three times: once as the assignment's target and once
+	// per operand of the `+`.  Collapsing those loads into one shared Value
+	// is exactly the bug this test catches.
+	if got, want := countOp(obj.prog, mload), 3; got != want {
+		t.Errorf("mload count = %d, want %d in prog %v", got, want, obj.prog)
+	}
+	if got, want := countOp(obj.prog, dload), 3; got != want {
+		t.Errorf("dload count = %d, want %d in prog %v", got, want, obj.prog)
+	}
+}
+
+// TestCodeGenConstantFolding compares the emitted obj.prog for programs
+// whose constant-foldable form should codegen identically to its
+// already-folded equivalent: FoldConstants is expected to reduce the first
+// down to the second before CodeGen ever walks it.
+func TestCodeGenConstantFolding(t *testing.T) {
+	testCases := []struct {
+		name     string
+		unfolded string
+		folded   string
+	}{
+		{
+			"constant arithmetic",
+			"counter x\n/$/ {\n  x = 1 + 2\n}\n",
+			"counter x\n/$/ {\n  x = 3\n}\n",
+		},
+		{
+			"additive identity",
+			"counter x\n/$/ {\n  x = x + 0\n}\n",
+			"counter x\n/$/ {\n  x = x\n}\n",
+		},
+		{
+			"constant float mod",
+			"counter x\n/$/ {\n  x = 5.0 % 2.0\n}\n",
+			"counter x\n/$/ {\n  x = 1.0\n}\n",
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			unfoldedAst, err := Parse(tc.name, strings.NewReader(tc.unfolded))
+			if err != nil {
+				t.Fatal(err)
+			}
+			foldedAst, err := Parse(tc.name, strings.NewReader(tc.folded))
+			if err != nil {
+				t.Fatal(err)
+			}
+			unfoldedObj, err := CodeGen(tc.name, unfoldedAst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			foldedObj, err := CodeGen(tc.name, foldedAst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(unfoldedObj.prog, foldedObj.prog) {
+				t.Errorf("unfolded prog %v != folded prog %v", unfoldedObj.prog, foldedObj.prog)
+			}
+		})
+	}
+}
+
+// TestCodeGenConstantFoldingCondElse guards against short-circuiting a
+// statically-false condNode by reusing the truth arm's codegen treatment:
+// the truth arm is always bracketed in setmatched(false)/setmatched(true),
+// but an else arm never is, so folding "if <false> {..} else {..}" down to
+// just the else arm must still skip that bracketing, the same as writing
+// the else arm's statements with no enclosing if at all.
+func TestCodeGenConstantFoldingCondElse(t *testing.T) {
+	ast, err := Parse("cond else fold", strings.NewReader(
+		"counter x\ncounter y\n/$/ {\n  if 1 == 2 {\n    x++\n  } else {\n    y++\n  }\n}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	foldedObj, err := CodeGen("cond else fold", ast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bareAst, err := Parse("cond else bare", strings.NewReader(
+		"counter x\ncounter y\n/$/ {\n  y++\n}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bareObj, err := CodeGen("cond else bare", bareAst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(bareObj.prog, foldedObj.prog) {
+		t.Errorf("folded if/else prog %v != bare else-only prog %v", foldedObj.prog, bareObj.prog)
+	}
+	// Only the enclosing /$/ block's own setmatched(false)/setmatched(true)
+	// pair remains; the folded else arm adds none.
+	if got, want := countOp(foldedObj.prog, setmatched), 2; got != want {
+		t.Errorf("setmatched count = %d, want %d in prog %v", got, want, foldedObj.prog)
+	}
+}
+
+// TestCodeGenCondElse guards the block-layout bug: a condNode with an
+// elseNode as the last statement in its enclosing block used to emit a
+// merge Block that aliased with the else arm laid out right after it,
+// so both arms fell into (or looped on) the else arm's code.
+func TestCodeGenCondElse(t *testing.T) {
+	ast, err := Parse("cond else", strings.NewReader(
+		"counter x\ncounter y\n/$/ {\n  if $1 == \"1\" {\n    x++\n  } else {\n    y++\n  }\n}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := CodeGen("cond else", ast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertNoSelfJump(t, obj.prog)
+	// Each arm increments a distinct counter exactly once.
+	if got, want := countOp(obj.prog, inc), 2; got != want {
+		t.Errorf("inc count = %d, want %d in prog %v", got, want, obj.prog)
+	}
+}
+
+// TestCodeGenNestedCond exercises a condNode nested inside another, both
+// as the last statement in their enclosing block, which lays out three
+// merge Blocks in a row with no explicit Term on any of them.
+func TestCodeGenNestedCond(t *testing.T) {
+	ast, err := Parse("nested cond", strings.NewReader(
+		"counter x\n/$/ {\n  if $1 == \"1\" {\n    if $2 == \"2\" {\n      x++\n    }\n  }\n}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := CodeGen("nested cond", ast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertNoSelfJump(t, obj.prog)
+	if got, want := countOp(obj.prog, inc), 1; got != want {
+		t.Errorf("inc count = %d, want %d in prog %v", got, want, obj.prog)
+	}
+}
+
+// TestCodeGenOtherwise exercises the otherwiseNode path through the same
+// condNode machinery as an if/else, as the sole top-level action.
+func TestCodeGenOtherwise(t *testing.T) {
+	ast, err := Parse("otherwise", strings.NewReader(
+		"counter x\ncounter y\n/foo/ {\n  x++\n}\notherwise {\n  y++\n}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := CodeGen("otherwise", ast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertNoSelfJump(t, obj.prog)
+	if got, want := countOp(obj.prog, inc), 2; got != want {
+		t.Errorf("inc count = %d, want %d in prog %v", got, want, obj.prog)
+	}
+}
@@ -0,0 +1,407 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"math"
+	"strconv"
+)
+
+// FoldConstants rewrites ast, folding constant arithmetic and conversions
+// down to a single literal, simplifying a handful of algebraic identities,
+// and short-circuiting condNodes whose condition is now known at compile
+// time.  It runs as an AST-to-AST pass before CodeGen, so CodeGen itself
+// stays unaware that folding ever happened; it just sees a smaller tree.
+func FoldConstants(ast astNode) astNode {
+	Walk(&folder{}, ast)
+	return ast
+}
+
+// folder applies fold1 to every expression-valued field it knows about,
+// bottom-up: by the time a node's VisitAfter runs, Walk has already
+// visited (and folded) everything beneath it, so a single non-recursive
+// fold1 call per field is enough to bubble constants up the tree one
+// level at a time.
+type folder struct{}
+
+func (f *folder) VisitBefore(node astNode) Visitor { return f }
+
+func (f *folder) VisitAfter(node astNode) {
+	switch n := node.(type) {
+	case *binaryExprNode:
+		n.lhs = fold1(n.lhs)
+		n.rhs = fold1(n.rhs)
+	case *unaryExprNode:
+		n.n = fold1(n.n)
+	case *convNode:
+		n.n = fold1(n.n)
+	case *builtinNode:
+		if n.args != nil {
+			if el, ok := n.args.(*exprlistNode); ok {
+				for i, a := range el.children {
+					el.children[i] = fold1(a)
+				}
+			}
+		}
+	case *condNode:
+		if n.cond != nil {
+			n.cond = fold1(n.cond)
+		}
+		if isFalsy(n.cond) {
+			// The truth arm can never run, so splice in whatever runs
+			// unconditionally instead: the else arm if there is one, or
+			// nothing.  Either way that body must keep the treatment an
+			// else arm gets at codegen time -- inline, with no
+			// setmatched(false)/setmatched(true) bracketing -- rather
+			// than the truth arm's, which codegen.go always applies
+			// regardless of whether the arm is reached by a real branch
+			// or an unconditional jump.  fromElse tells codegen.go that,
+			// so it skips the bracketing instead of moving an else arm's
+			// body into a slot that implies it gets wrapped.
+			if n.elseNode != nil {
+				n.truthNode, n.elseNode = n.elseNode, nil
+			} else {
+				n.truthNode = &stmtlistNode{}
+			}
+			n.fromElse = true
+			n.cond = nil
+		} else if isTruthy(n.cond) {
+			n.cond = nil
+		}
+	case *delNode:
+		n.n = fold1(n.n)
+	}
+}
+
+// fold1 folds n itself, one level, assuming any foldable descendants have
+// already been folded by the time n is reached.  It returns n unchanged
+// when there's nothing to fold.
+func fold1(n astNode) astNode {
+	switch e := n.(type) {
+	case *binaryExprNode:
+		return foldBinary(e)
+	case *unaryExprNode:
+		return foldUnary(e)
+	case *convNode:
+		return foldConv(e)
+	default:
+		return n
+	}
+}
+
+func foldBinary(e *binaryExprNode) astNode {
+	switch e.op {
+	case AND:
+		switch {
+		case isFalsy(e.lhs), isFalsy(e.rhs):
+			return falseConst()
+		case isTruthy(e.lhs):
+			return e.rhs
+		case isTruthy(e.rhs):
+			return e.lhs
+		}
+		return e
+
+	case OR:
+		switch {
+		case isTruthy(e.lhs), isTruthy(e.rhs):
+			return trueConst()
+		case isFalsy(e.lhs):
+			return e.rhs
+		case isFalsy(e.rhs):
+			return e.lhs
+		}
+		return e
+
+	case LT, GT, LE, GE, EQ, NE:
+		if v, ok := foldCompare(e); ok {
+			if v {
+				return trueConst()
+			}
+			return falseConst()
+		}
+		return e
+
+	case BITAND:
+		if sameNode(e.lhs, e.rhs) {
+			return e.lhs
+		}
+		if li, lok := e.lhs.(*intConstNode); lok {
+			if ri, rok := e.rhs.(*intConstNode); rok {
+				return &intConstNode{i: li.i & ri.i}
+			}
+		}
+		return e
+
+	case BITOR, XOR, SHL, SHR:
+		li, lok := e.lhs.(*intConstNode)
+		ri, rok := e.rhs.(*intConstNode)
+		if !lok || !rok {
+			return e
+		}
+		switch e.op {
+		case BITOR:
+			return &intConstNode{i: li.i | ri.i}
+		case XOR:
+			return &intConstNode{i: li.i ^ ri.i}
+		case SHL:
+			return &intConstNode{i: li.i << uint(ri.i)}
+		case SHR:
+			return &intConstNode{i: li.i >> uint(ri.i)}
+		}
+		return e
+
+	case PLUS, MINUS, MUL, DIV, MOD, POW:
+		if v := foldArith(e); v != nil {
+			return v
+		}
+		return simplifyIdentity(e)
+	}
+	return e
+}
+
+// foldArith evaluates e when both operands are the same kind of constant,
+// returning nil if it can't (e.g. mixed types, or a division by a
+// constant zero, which is left for the VM to fault on at run time as it
+// does today).
+func foldArith(e *binaryExprNode) astNode {
+	if li, ok := e.lhs.(*intConstNode); ok {
+		if ri, ok := e.rhs.(*intConstNode); ok {
+			if (e.op == DIV || e.op == MOD) && ri.i == 0 {
+				return nil
+			}
+			switch e.op {
+			case PLUS:
+				return &intConstNode{i: li.i + ri.i}
+			case MINUS:
+				return &intConstNode{i: li.i - ri.i}
+			case MUL:
+				return &intConstNode{i: li.i * ri.i}
+			case DIV:
+				return &intConstNode{i: li.i / ri.i}
+			case MOD:
+				return &intConstNode{i: li.i % ri.i}
+			case POW:
+				return &intConstNode{i: ipow(li.i, ri.i)}
+			}
+		}
+	}
+	if lf, ok := e.lhs.(*floatConstNode); ok {
+		if rf, ok := e.rhs.(*floatConstNode); ok {
+			switch e.op {
+			case PLUS:
+				return &floatConstNode{f: lf.f + rf.f}
+			case MINUS:
+				return &floatConstNode{f: lf.f - rf.f}
+			case MUL:
+				return &floatConstNode{f: lf.f * rf.f}
+			case DIV:
+				if rf.f == 0 {
+					return nil
+				}
+				return &floatConstNode{f: lf.f / rf.f}
+			case MOD:
+				if rf.f == 0 {
+					return nil
+				}
+				return &floatConstNode{f: math.Mod(lf.f, rf.f)}
+			case POW:
+				return &floatConstNode{f: math.Pow(lf.f, rf.f)}
+			}
+		}
+	}
+	if e.op == PLUS {
+		if ls, ok := e.lhs.(*stringConstNode); ok {
+			if rs, ok := e.rhs.(*stringConstNode); ok {
+				return &stringConstNode{text: ls.text + rs.text}
+			}
+		}
+	}
+	return nil
+}
+
+// simplifyIdentity catches the handful of algebraic identities that hold
+// regardless of what the non-constant side is: x+0, 0+x, x*1, 1*x, x*0,
+// 0*x.
+func simplifyIdentity(e *binaryExprNode) astNode {
+	switch e.op {
+	case PLUS:
+		if isZero(e.rhs) {
+			return e.lhs
+		}
+		if isZero(e.lhs) {
+			return e.rhs
+		}
+	case MUL:
+		if isOne(e.rhs) {
+			return e.lhs
+		}
+		if isOne(e.lhs) {
+			return e.rhs
+		}
+		if isZero(e.rhs) {
+			return e.rhs
+		}
+		if isZero(e.lhs) {
+			return e.lhs
+		}
+	}
+	return e
+}
+
+func foldUnary(e *unaryExprNode) astNode {
+	if e.op == NOT {
+		if inner, ok := e.n.(*unaryExprNode); ok && inner.op == NOT {
+			return inner.n
+		}
+	}
+	return e
+}
+
+// foldConv evaluates a convNode when its argument is already a constant,
+// mirroring the cases emitConversion handles at codegen time.  Calls to
+// the int, float and string builtins are builtinNodes, not convNodes, and
+// are not folded: only their arguments are.
+func foldConv(e *convNode) astNode {
+	switch in := e.n.(type) {
+	case *intConstNode:
+		if Equals(Float, e.Type()) {
+			return &floatConstNode{f: float64(in.i)}
+		}
+		if Equals(String, e.Type()) {
+			return &stringConstNode{text: strconv.FormatInt(in.i, 10)}
+		}
+	case *floatConstNode:
+		if Equals(String, e.Type()) {
+			return &stringConstNode{text: strconv.FormatFloat(in.f, 'g', -1, 64)}
+		}
+	case *stringConstNode:
+		if Equals(Float, e.Type()) {
+			if f, err := strconv.ParseFloat(in.text, 64); err == nil {
+				return &floatConstNode{f: f}
+			}
+		}
+		if Equals(Int, e.Type()) {
+			if i, err := strconv.ParseInt(in.text, 10, 64); err == nil {
+				return &intConstNode{i: i}
+			}
+		}
+	}
+	return e
+}
+
+func foldCompare(e *binaryExprNode) (bool, bool) {
+	var cmp int
+	switch {
+	case isIntConst(e.lhs) && isIntConst(e.rhs):
+		li, ri := e.lhs.(*intConstNode).i, e.rhs.(*intConstNode).i
+		cmp = sign(li - ri)
+	case isFloatConst(e.lhs) && isFloatConst(e.rhs):
+		lf, rf := e.lhs.(*floatConstNode).f, e.rhs.(*floatConstNode).f
+		cmp = sign64(lf - rf)
+	default:
+		return false, false
+	}
+	switch e.op {
+	case LT:
+		return cmp < 0, true
+	case GT:
+		return cmp > 0, true
+	case LE:
+		return cmp <= 0, true
+	case GE:
+		return cmp >= 0, true
+	case EQ:
+		return cmp == 0, true
+	case NE:
+		return cmp != 0, true
+	}
+	return false, false
+}
+
+func sign(i int64) int {
+	switch {
+	case i < 0:
+		return -1
+	case i > 0:
+		return 1
+	}
+	return 0
+}
+
+func sign64(f float64) int {
+	switch {
+	case f < 0:
+		return -1
+	case f > 0:
+		return 1
+	}
+	return 0
+}
+
+func isIntConst(n astNode) bool   { _, ok := n.(*intConstNode); return ok }
+func isFloatConst(n astNode) bool { _, ok := n.(*floatConstNode); return ok }
+
+func isZero(n astNode) bool {
+	switch v := n.(type) {
+	case *intConstNode:
+		return v.i == 0
+	case *floatConstNode:
+		return v.f == 0
+	}
+	return false
+}
+
+func isOne(n astNode) bool {
+	switch v := n.(type) {
+	case *intConstNode:
+		return v.i == 1
+	case *floatConstNode:
+		return v.f == 1
+	}
+	return false
+}
+
+// isTruthy and isFalsy recognise the constant markers foldCompare, AND
+// and OR leave behind: an intConstNode{1} or intConstNode{0}, the only
+// stand-in this language has for a boolean since the VM has no bool type
+// of its own yet (see the "bool" case in builtinNode's VisitAfter).
+func isTruthy(n astNode) bool {
+	v, ok := n.(*intConstNode)
+	return ok && v.i != 0
+}
+
+func isFalsy(n astNode) bool {
+	v, ok := n.(*intConstNode)
+	return ok && v.i == 0
+}
+
+func trueConst() astNode  { return &intConstNode{i: 1} }
+func falseConst() astNode { return &intConstNode{i: 0} }
+
+// sameNode reports whether a and b are syntactically the same
+// metric/capture reference, which is enough to know that x&x == x
+// regardless of x's runtime value.
+func sameNode(a, b astNode) bool {
+	switch av := a.(type) {
+	case *idNode:
+		bv, ok := b.(*idNode)
+		return ok && av.sym != nil && av.sym == bv.sym
+	case *caprefNode:
+		bv, ok := b.(*caprefNode)
+		return ok && av.sym != nil && av.sym == bv.sym
+	}
+	return false
+}
+
+func ipow(a, b int64) int64 {
+	if b < 0 {
+		return 0
+	}
+	r := int64(1)
+	for ; b > 0; b-- {
+		r *= a
+	}
+	return r
+}
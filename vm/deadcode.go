@@ -0,0 +1,187 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"regexp"
+
+	"github.com/google/mtail/metrics"
+)
+
+// eliminateDeadCode runs a control-flow reachability analysis over
+// obj.prog, starting from PC 0 and following jmp, jm and jnm targets (the
+// same targets lower() in ssalower.go patches in), and drops any
+// instruction it can't reach.  It then compacts obj.m, obj.re and obj.str
+// down to the entries still referenced by the surviving mload, match and
+// str instructions, and remaps every operand that points into one of
+// those slices.  This is what keeps an `otherwise`/`else` arm that folded
+// away at compile time from leaving its regex compilations, and now-dead
+// metric declarations, sitting in the object uselessly.
+func eliminateDeadCode(obj *object) {
+	reachable := reachablePCs(obj.prog)
+
+	// A metric with no mload anywhere in the *original* program was never
+	// going to be referenced in the first place -- e.g. a
+	// declared-but-unused counter, kept around solely to register its zero
+	// value -- and dropping it would be an export regression, not dead-code
+	// elimination.  Only a metric that loses every one of its references to
+	// the reachability trim below is actually dead.  Regexes and strings
+	// have no such use: any that no surviving instruction references are
+	// dropped.
+	_, everM, _ := collectRefs(obj.prog)
+
+	// A jump to len(obj.prog) ends the program; it keeps pointing just
+	// past the last surviving instruction.
+	pcRemap := make([]int, len(obj.prog)+1)
+	prog := make([]instr, 0, len(obj.prog))
+	for pc, i := range obj.prog {
+		if !reachable[pc] {
+			pcRemap[pc] = -1
+			continue
+		}
+		pcRemap[pc] = len(prog)
+		prog = append(prog, i)
+	}
+	pcRemap[len(obj.prog)] = len(prog)
+	for i := range prog {
+		switch prog[i].op {
+		case jmp, jm, jnm:
+			prog[i].opnd = pcRemap[prog[i].opnd.(int)]
+		}
+	}
+
+	reIdx, mIdx, sIdx := collectRefs(prog)
+	for i := range obj.m {
+		if !everM.live[i] {
+			mIdx.mark(i)
+		}
+	}
+	reIdx.finalize(len(obj.re))
+	mIdx.finalize(len(obj.m))
+	sIdx.finalize(len(obj.str))
+
+	for i := range prog {
+		switch prog[i].op {
+		case match:
+			prog[i].opnd = reIdx.remap[prog[i].opnd.(int)]
+		case mload:
+			prog[i].opnd = mIdx.remap[prog[i].opnd.(int)]
+		case str:
+			prog[i].opnd = sIdx.remap[prog[i].opnd.(int)]
+		}
+	}
+	for i := 0; i+1 < len(prog); i++ {
+		if prog[i].op == push && prog[i+1].op == capref {
+			if addr, ok := prog[i].opnd.(int); ok {
+				prog[i].opnd = reIdx.remap[addr]
+			}
+		}
+	}
+
+	obj.prog = prog
+	newRe := make([]*regexp.Regexp, 0, len(reIdx.remap))
+	for i, re := range obj.re {
+		if reIdx.live[i] {
+			newRe = append(newRe, re)
+		}
+	}
+	obj.re = newRe
+
+	newM := make([]*metrics.Metric, 0, len(mIdx.remap))
+	for i, m := range obj.m {
+		if mIdx.live[i] {
+			newM = append(newM, m)
+		}
+	}
+	obj.m = newM
+
+	newStr := make([]string, 0, len(sIdx.remap))
+	for i, s := range obj.str {
+		if sIdx.live[i] {
+			newStr = append(newStr, s)
+		}
+	}
+	obj.str = newStr
+}
+
+// reachablePCs walks prog from PC 0, following fallthrough and every
+// jmp/jm/jnm edge, and returns which PCs were visited.
+func reachablePCs(prog []instr) []bool {
+	reachable := make([]bool, len(prog))
+	if len(prog) == 0 {
+		return reachable
+	}
+	work := []int{0}
+	for len(work) > 0 {
+		pc := work[len(work)-1]
+		work = work[:len(work)-1]
+		if pc < 0 || pc >= len(prog) || reachable[pc] {
+			continue
+		}
+		reachable[pc] = true
+		switch prog[pc].op {
+		case jmp:
+			work = append(work, prog[pc].opnd.(int))
+			continue
+		case jm, jnm:
+			work = append(work, prog[pc].opnd.(int))
+		}
+		work = append(work, pc+1)
+	}
+	return reachable
+}
+
+// collectRefs scans prog for mload, match and str instructions (plus the
+// push;capref pair that addresses a regex the same way match does) and
+// returns a refSet per data slice with every referenced index marked live.
+func collectRefs(prog []instr) (re, m, s *refSet) {
+	re, m, s = newRefSet(), newRefSet(), newRefSet()
+	for _, i := range prog {
+		switch i.op {
+		case match:
+			re.mark(i.opnd.(int))
+		case mload:
+			m.mark(i.opnd.(int))
+		case str:
+			s.mark(i.opnd.(int))
+		}
+	}
+	// A push immediately followed by a capref is pushing a regex
+	// address, not a plain constant, so its operand lives in the same
+	// index space as match's and must be kept and remapped alongside it.
+	for i := 0; i+1 < len(prog); i++ {
+		if prog[i].op == push && prog[i+1].op == capref {
+			if addr, ok := prog[i].opnd.(int); ok {
+				re.mark(addr)
+			}
+		}
+	}
+	return re, m, s
+}
+
+// refSet records which indices into one of obj's data slices are still
+// referenced by the surviving program, and the compacted index each one
+// is remapped to once finalize has been called.
+type refSet struct {
+	live  map[int]bool
+	remap map[int]int
+}
+
+func newRefSet() *refSet {
+	return &refSet{live: make(map[int]bool), remap: make(map[int]int)}
+}
+
+func (r *refSet) mark(i int) { r.live[i] = true }
+
+// finalize assigns a compacted index to every marked index below n,
+// preserving relative order.
+func (r *refSet) finalize(n int) {
+	next := 0
+	for i := 0; i < n; i++ {
+		if r.live[i] {
+			r.remap[i] = next
+			next++
+		}
+	}
+}
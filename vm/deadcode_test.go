@@ -0,0 +1,91 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/google/mtail/metrics"
+)
+
+// TestEliminateDeadCode builds an object whose prog has an unreachable
+// region -- the shape an otherwise/else arm that folds away at compile
+// time, or a branch a later pass proves can't be taken, leaves behind --
+// and checks both that the dead instructions are dropped with surviving
+// jump targets remapped to their new PCs, and that the regex and metric
+// only the dead region referenced, and the string nothing references, are
+// compacted out of obj.re/obj.m/obj.str while the ones the live region uses
+// are kept and renumbered.
+func TestEliminateDeadCode(t *testing.T) {
+	deadRe, liveRe := regexp.MustCompile("dead"), regexp.MustCompile("live")
+	deadMetric := metrics.NewMetric("dead_counter", "testprog", metrics.Counter, metrics.Int)
+	liveMetric := metrics.NewMetric("live_counter", "testprog", metrics.Counter, metrics.Int)
+
+	obj := &object{
+		re:  []*regexp.Regexp{deadRe, liveRe},
+		m:   []*metrics.Metric{deadMetric, liveMetric},
+		str: []string{"dead", "live"},
+		prog: []instr{
+			{jmp, 3},   // 0: skip the dead block below
+			{match, 0}, // 1: dead -- references re[0]
+			{mload, 0}, // 2: dead -- references m[0]
+			{match, 1}, // 3: live -- references re[1]
+			{jnm, 6},   // 4
+			{jmp, 7},   // 5
+			{mload, 1}, // 6: live -- references m[1]
+			{str, 1},   // 7: live -- references str[1]
+		},
+	}
+
+	eliminateDeadCode(obj)
+
+	want := []instr{
+		{jmp, 1},
+		{match, 0},
+		{jnm, 4},
+		{jmp, 5},
+		{mload, 0},
+		{str, 0},
+	}
+	if !reflect.DeepEqual(obj.prog, want) {
+		t.Errorf("prog = %v, want %v", obj.prog, want)
+	}
+	if got := len(obj.re); got != 1 || obj.re[0] != liveRe {
+		t.Errorf("re = %v, want only liveRe", obj.re)
+	}
+	if got := len(obj.m); got != 1 || obj.m[0] != liveMetric {
+		t.Errorf("m = %v, want only liveMetric", obj.m)
+	}
+	if got := len(obj.str); got != 1 || obj.str[0] != "live" {
+		t.Errorf("str = %v, want only %q", obj.str, "live")
+	}
+}
+
+// TestEliminateDeadCodeKeepsDeclaredButUnusedMetric guards against treating
+// "never referenced by any mload" as equivalent to "only referenced from
+// now-unreachable code". A counter declared and zero-initialized but never
+// read or incremented anywhere -- declNode's own doc explains scalar
+// counters exist to register that zero value -- has no mload at all, in
+// live code or dead, so it must survive even though nothing marks it live
+// the way a used metric would.
+func TestEliminateDeadCodeKeepsDeclaredButUnusedMetric(t *testing.T) {
+	usedMetric := metrics.NewMetric("used_counter", "testprog", metrics.Counter, metrics.Int)
+	unusedMetric := metrics.NewMetric("unused_counter", "testprog", metrics.Counter, metrics.Int)
+
+	obj := &object{
+		m: []*metrics.Metric{usedMetric, unusedMetric},
+		prog: []instr{
+			{mload, 0}, // 0: live -- references m[0]; m[1] is never loaded at all
+			{inc, nil}, // 1
+		},
+	}
+
+	eliminateDeadCode(obj)
+
+	if got := len(obj.m); got != 2 {
+		t.Errorf("m = %v, want both usedMetric and unusedMetric kept", obj.m)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package peephole implements a small, bytecode-agnostic peephole
+// rewriter: it slides a window over a sequence of instructions and
+// applies the first Rule that matches, repeating to a fixed point.  It
+// knows nothing about any particular VM's opcode set; the host package
+// supplies that via Rule.Match and translates Inst back to its own
+// instruction type.
+package peephole
+
+// Inst is a generic opcode+operand pair that Run pattern-matches over.
+type Inst struct {
+	Op      string
+	Operand interface{}
+}
+
+// Rule inspects the instructions starting at some position and, if they
+// match a pattern worth simplifying, returns the replacement sequence
+// (which may be shorter than the match, or empty to delete it outright)
+// and how many instructions of window it consumed.  consumed == 0 means
+// no match.
+type Rule struct {
+	Name  string
+	Match func(window []Inst) (replacement []Inst, consumed int)
+}
+
+// MaxWindow is the longest run of instructions Run offers a Rule at once;
+// a Rule that needs more than this many never matches.
+const MaxWindow = 4
+
+// Run repeatedly scans prog for the first position where a Rule matches,
+// splices in its replacement, and re-scans from that position until a
+// full pass makes no further changes.
+//
+// It returns the rewritten stream alongside a remap slice the same
+// length as prog: remap[i] is the index into the result that
+// instruction i now corresponds to.  An instruction absorbed into an
+// earlier fusion maps to that fusion's position; an instruction deleted
+// outright maps to wherever control falls through to next.  This lets a
+// caller that tracks jump targets by original PC fix them up after the
+// rewrite without Run needing to know what a jump even is.
+func Run(prog []Inst, rules []Rule) ([]Inst, []int) {
+	type group struct {
+		inst   Inst
+		origin []int
+	}
+	cur := make([]group, len(prog))
+	for i, ins := range prog {
+		cur[i] = group{inst: ins, origin: []int{i}}
+	}
+
+	for {
+		changed := false
+		for i := 0; i < len(cur); {
+			end := i + MaxWindow
+			if end > len(cur) {
+				end = len(cur)
+			}
+			window := make([]Inst, end-i)
+			for k := range window {
+				window[k] = cur[i+k].inst
+			}
+
+			fired := false
+			for _, rule := range rules {
+				repl, consumed := rule.Match(window)
+				if consumed == 0 {
+					continue
+				}
+				var origin []int
+				for k := 0; k < consumed; k++ {
+					origin = append(origin, cur[i+k].origin...)
+				}
+				newGroups := make([]group, len(repl))
+				for k, r := range repl {
+					newGroups[k] = group{inst: r}
+				}
+				if len(newGroups) > 0 {
+					newGroups[0].origin = origin
+				}
+				rest := append([]group{}, cur[i+consumed:]...)
+				cur = append(append(cur[:i:i], newGroups...), rest...)
+				// If the whole match disappeared, its origin is left
+				// unmapped here and folded into whatever survives after
+				// it in the backfill pass below.
+				fired = true
+				changed = true
+				break
+			}
+			if !fired {
+				i++
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+
+	out := make([]Inst, len(cur))
+	remap := make([]int, len(prog))
+	for i := range remap {
+		remap[i] = -1
+	}
+	for j, g := range cur {
+		out[j] = g.inst
+		for _, orig := range g.origin {
+			remap[orig] = j
+		}
+	}
+	// Anything still unmapped was deleted outright; it falls through to
+	// wherever the next surviving instruction landed, or off the end of
+	// the program if nothing survived after it.
+	for i := len(remap) - 1; i >= 0; i-- {
+		if remap[i] != -1 {
+			continue
+		}
+		if i+1 < len(remap) {
+			remap[i] = remap[i+1]
+		} else {
+			remap[i] = len(out)
+		}
+	}
+	return out, remap
+}
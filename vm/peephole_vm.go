@@ -0,0 +1,168 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import "github.com/google/mtail/vm/peephole"
+
+// opcodeLabel gives peephole.Rule.Match something to switch on without
+// this package having to know how opcode is represented; the real
+// opcode and operand travel along unchanged in Inst.Operand, so no
+// information is lost translating back.
+func opcodeLabel(op opcode) string {
+	switch op {
+	case push:
+		return "push"
+	case iadd:
+		return "iadd"
+	case i2f:
+		return "i2f"
+	case f2s:
+		return "f2s"
+	case i2s:
+		return "i2s"
+	case setmatched:
+		return "setmatched"
+	default:
+		return "other"
+	}
+}
+
+// vmOperand is what every peephole.Inst.Operand built by this file
+// actually holds: the real opcode and operand, so rules and the final
+// conversion back to []instr never have to guess either one.
+type vmOperand struct {
+	op   opcode
+	opnd interface{}
+}
+
+func toPeephole(prog []instr) []peephole.Inst {
+	out := make([]peephole.Inst, len(prog))
+	for i, ins := range prog {
+		out[i] = peephole.Inst{Op: opcodeLabel(ins.op), Operand: vmOperand{ins.op, ins.opnd}}
+	}
+	return out
+}
+
+func fromPeephole(insts []peephole.Inst) []instr {
+	out := make([]instr, len(insts))
+	for i, ins := range insts {
+		v := ins.Operand.(vmOperand)
+		out[i] = instr{v.op, v.opnd}
+	}
+	return out
+}
+
+// peepholeRules is the set of local, PC-independent simplifications run
+// over every program: of two adjacent setmatched instructions, only the
+// second's effect is ever observed, so the first can be dropped.
+//
+// Two rules that used to live here were removed on review: "push 0; iadd"
+// can no longer fire now that FoldConstants' simplifyIdentity rewrites
+// x+0 away before CodeGen ever runs (see constfold.go), and fusing
+// "i2f; f2s" into "i2s" changed the formatted output for integers outside
+// float64's exact range (|x| > 2^53) -- a peephole rule must only replace
+// a sequence with one that is observably identical.
+var peepholeRules = []peephole.Rule{
+	{
+		Name: "redundant-setmatched",
+		Match: func(w []peephole.Inst) ([]peephole.Inst, int) {
+			if len(w) < 2 || w[0].Op != "setmatched" || w[1].Op != "setmatched" {
+				return nil, 0
+			}
+			return []peephole.Inst{w[1]}, 2
+		},
+	},
+}
+
+// peepholeOptimize shrinks obj.prog with peepholeRules and then collapses
+// any "jnm L; jmp L2" or "jm L; jmp L2" pair it finds where L is just the
+// instruction immediately after the jmp -- the shape lower() emits for a
+// branch whose Else Block is laid out right after it, as an if/else
+// condNode's is, for both the plain and inverted (LE/GE/NE) comparisons -- into a
+// single "jm L2" or "jnm L2" respectively, since falling through already
+// reaches L for free.
+//
+// The mload;dload;del triple mentioned in the issue that motivated this
+// pass no longer exists: delNode retags the dload Value it walks into a
+// del directly (see codegen.go), so there's nothing left here to fuse.
+func peepholeOptimize(obj *object) {
+	rewritten, remap := peephole.Run(toPeephole(obj.prog), peepholeRules)
+	prog := fromPeephole(rewritten)
+	for i := range prog {
+		switch prog[i].op {
+		case jmp, jm, jnm:
+			// A target of len(obj.prog) ends the program and stays past the end.
+			if t := prog[i].opnd.(int); t < len(remap) {
+				prog[i].opnd = remap[t]
+			} else {
+				prog[i].opnd = len(prog)
+			}
+		}
+	}
+	obj.prog = simplifyJumpChains(prog)
+}
+
+func simplifyJumpChains(prog []instr) []instr {
+	targeted := make(map[int]bool, len(prog))
+	for _, ins := range prog {
+		switch ins.op {
+		case jmp, jm, jnm:
+			targeted[ins.opnd.(int)] = true
+		}
+	}
+
+	remove := make([]bool, len(prog))
+	any := false
+	for i := 0; i+1 < len(prog); i++ {
+		if prog[i+1].op != jmp {
+			continue
+		}
+		// jnm L; jmp L2; L: collapses to jm L2 (falling through already
+		// reaches L for free when not matched), and the mirror -- jm L;
+		// jmp L2; L: -- collapses to jnm L2 the same way when matched.
+		// lower() emits jm instead of jnm whenever instrAux.invert is
+		// set (the LE/GE/NE comparison path), so both shapes show up in
+		// practice.
+		var inverted opcode
+		switch prog[i].op {
+		case jnm:
+			inverted = jm
+		case jm:
+			inverted = jnm
+		default:
+			continue
+		}
+		if targeted[i+1] {
+			continue
+		}
+		if target, ok := prog[i].opnd.(int); !ok || target != i+2 {
+			continue
+		}
+		prog[i] = instr{inverted, prog[i+1].opnd}
+		remove[i+1] = true
+		any = true
+	}
+	if !any {
+		return prog
+	}
+
+	pcRemap := make([]int, len(prog)+1)
+	out := make([]instr, 0, len(prog))
+	for pc, ins := range prog {
+		if remove[pc] {
+			pcRemap[pc] = -1
+			continue
+		}
+		pcRemap[pc] = len(out)
+		out = append(out, ins)
+	}
+	pcRemap[len(prog)] = len(out)
+	for i := range out {
+		switch out[i].op {
+		case jmp, jm, jnm:
+			out[i].opnd = pcRemap[out[i].opnd.(int)]
+		}
+	}
+	return out
+}
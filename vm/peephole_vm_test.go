@@ -0,0 +1,74 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestPeepholeOptimize exercises both surviving rules together on one
+// program: the first of two adjacent setmatched instructions is dropped,
+// and a "jnm L; jmp L2" pair -- the shape lower() emits for an if/else
+// condNode's branch, where L is just the instruction after the jmp --
+// collapses to a single "jm L2", since falling through already reaches L
+// for free. Each rewrite must leave every surviving jump landing on the
+// same logical instruction it did before: the "not matched" path still
+// runs mload before falling into str, and the "matched" path still skips
+// straight to str.
+func TestPeepholeOptimize(t *testing.T) {
+	obj := &object{
+		prog: []instr{
+			{setmatched, false}, // 0: dropped, only the following one is observed
+			{setmatched, true},  // 1
+			{cmp, 0},            // 2
+			{jnm, 5},            // 3: not matched -> 5 (mload), the instr right after the jmp below
+			{jmp, 6},            // 4: matched -> 6 (str)
+			{mload, 0},          // 5
+			{str, 0},            // 6
+		},
+	}
+
+	peepholeOptimize(obj)
+
+	want := []instr{
+		{setmatched, true},
+		{cmp, 0},
+		{jm, 4}, // matched -> str, directly
+		{mload, 0},
+		{str, 0},
+	}
+	if !reflect.DeepEqual(obj.prog, want) {
+		t.Errorf("prog = %v, want %v", obj.prog, want)
+	}
+}
+
+// TestPeepholeOptimizeInvertedCmp exercises the mirrored jump-chain rule:
+// lower() emits jm instead of jnm whenever instrAux.invert is set, which is
+// the LE/GE/NE comparison path, so a "jm L; jmp L2" chain -- e.g. the bytecode for
+// "x <= y" -- needs to collapse to "jnm L2" the same way its jnm/jmp
+// counterpart collapses to "jm L2".
+func TestPeepholeOptimizeInvertedCmp(t *testing.T) {
+	obj := &object{
+		prog: []instr{
+			{cmp, 0},   // 0
+			{jm, 3},    // 1: matched -> 3 (mload), the instr right after the jmp below
+			{jmp, 4},   // 2: not matched -> 4 (str)
+			{mload, 0}, // 3
+			{str, 0},   // 4
+		},
+	}
+
+	peepholeOptimize(obj)
+
+	want := []instr{
+		{cmp, 0},
+		{jnm, 3}, // not matched -> str, directly
+		{mload, 0},
+		{str, 0},
+	}
+	if !reflect.DeepEqual(obj.prog, want) {
+		t.Errorf("prog = %v, want %v", obj.prog, want)
+	}
+}
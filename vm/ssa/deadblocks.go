@@ -0,0 +1,25 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package ssa
+
+// DeadBlocks is a Pass that drops every Block unreachable from Entry and
+// lays the survivors out in the ReversePostorder lower() needs. An arm
+// whose condition folds to false is removed from the AST before the SSA
+// form exists (see vm's constfold.go), but a condNode whose condition
+// folds to true still builds its else Block, which nothing jumps to; Run
+// drops that Block here.  A Block can also go unreachable after a later Pass rewrites a
+// Term (e.g. a branch a subsequent fold proves always taken one way), and
+// this is where that gets cleaned up before lowering.
+type DeadBlocks struct{}
+
+// Name implements Pass.
+func (DeadBlocks) Name() string { return "deadblocks" }
+
+// Run implements Pass.
+func (DeadBlocks) Run(f *Func) bool {
+	order := f.ReversePostorder()
+	changed := len(order) != len(f.Blocks)
+	f.Blocks = order
+	return changed
+}
@@ -0,0 +1,86 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package ssa
+
+// Dominators computes the immediate dominator of every reachable Block in
+// f, using the iterative algorithm of Cooper, Harvey and Kennedy ("A Simple,
+// Fast Dominance Algorithm") over f.ReversePostorder, which converges in a
+// handful of passes on the small, mostly-linear CFGs this compiler
+// produces.  Callers must run f.LinkPreds first.
+//
+// Nothing in vm/ calls this yet: it exists as the dominance check
+// NewValue's doc says sound per-block value numbering needs, not as a
+// delivered optimization in its own right.  Value numbering itself
+// remains unimplemented, and Block.Phis is unconstructed scaffolding for
+// the same reason -- see the doc comments on NewValue and Block.
+//
+// The returned map has one entry per reachable Block, including the entry
+// block, which dominates itself.
+func (f *Func) Dominators() map[*Block]*Block {
+	order := f.ReversePostorder()
+	postIndex := make(map[*Block]int, len(order))
+	for i, b := range order {
+		postIndex[b] = i
+	}
+
+	idom := make(map[*Block]*Block, len(order))
+	idom[f.Entry] = f.Entry
+
+	changed := true
+	for changed {
+		changed = false
+		// Skip the entry block; it's fixed above.
+		for i := len(order) - 1; i >= 0; i-- {
+			b := order[i]
+			if b == f.Entry {
+				continue
+			}
+			var newIdom *Block
+			for _, p := range b.Preds() {
+				if idom[p] == nil {
+					continue
+				}
+				if newIdom == nil {
+					newIdom = p
+					continue
+				}
+				newIdom = intersect(idom, postIndex, newIdom, p)
+			}
+			if newIdom == nil {
+				continue
+			}
+			if idom[b] != newIdom {
+				idom[b] = newIdom
+				changed = true
+			}
+		}
+	}
+	return idom
+}
+
+func intersect(idom map[*Block]*Block, index map[*Block]int, a, b *Block) *Block {
+	for a != b {
+		for index[a] > index[b] {
+			a = idom[a]
+		}
+		for index[b] > index[a] {
+			b = idom[b]
+		}
+	}
+	return a
+}
+
+// Dominates reports whether a dominates b, given the result of a prior
+// call to Dominators.
+func Dominates(idom map[*Block]*Block, a, b *Block) bool {
+	for {
+		if a == b {
+			return true
+		}
+		if b == idom[b] {
+			return a == b
+		}
+		b = idom[b]
+	}
+}
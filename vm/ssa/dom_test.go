@@ -0,0 +1,58 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package ssa
+
+import "testing"
+
+// TestDominatorsLinearChain checks the straight-line case: every Block in
+// a chain with no branches is dominated by everything before it.
+func TestDominatorsLinearChain(t *testing.T) {
+	f := NewFunc("linear")
+	b1 := f.NewBlock("b1")
+	b2 := f.NewBlock("b2")
+	f.Entry.Term = Term{Kind: TermJump, Then: b1}
+	b1.Term = Term{Kind: TermJump, Then: b2}
+	f.LinkPreds()
+
+	idom := f.Dominators()
+
+	if !Dominates(idom, f.Entry, b2) {
+		t.Errorf("Entry should dominate b2")
+	}
+	if Dominates(idom, b2, f.Entry) {
+		t.Errorf("b2 should not dominate Entry")
+	}
+	if idom[b2] != b1 {
+		t.Errorf("idom[b2] = %v, want b1", idom[b2])
+	}
+}
+
+// TestDominatorsDiamond checks the diamond case: a Block reachable through
+// either of two distinct arms is only dominated by their common ancestor,
+// not by either arm alone.
+func TestDominatorsDiamond(t *testing.T) {
+	f := NewFunc("diamond")
+	a := f.NewBlock("a")
+	b := f.NewBlock("b")
+	merge := f.NewBlock("merge")
+	f.Entry.Term = Term{Kind: TermBranch, Then: a, Else: b}
+	a.Term = Term{Kind: TermJump, Then: merge}
+	b.Term = Term{Kind: TermJump, Then: merge}
+	f.LinkPreds()
+
+	idom := f.Dominators()
+
+	if idom[merge] != f.Entry {
+		t.Errorf("idom[merge] = %v, want Entry", idom[merge])
+	}
+	if Dominates(idom, a, merge) {
+		t.Errorf("a should not dominate merge: it can be reached via b instead")
+	}
+	if Dominates(idom, b, merge) {
+		t.Errorf("b should not dominate merge: it can be reached via a instead")
+	}
+	if !Dominates(idom, f.Entry, merge) {
+		t.Errorf("Entry should dominate merge")
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package ssa
+
+// ReversePostorder returns f's Blocks reachable from Entry, in reverse
+// postorder: every Block appears after every other Block that can reach
+// it by following Succs without passing through it again.  Entry is
+// always first; a Block nothing can reach from Entry is dropped.
+//
+// This is the order the lowering in vm's ssalower.go lays bytecode out
+// in, and it matters: codegen.go's condNode handling creates a merge
+// Block before it creates the else Block, so walking Func.Blocks in
+// creation order can place the else arm right after an empty merge Block
+// whose Term was never explicitly set, because nothing in the source
+// follows the if/else.  A Block with no Values of its own occupies zero
+// bytes, so that merge Block's start PC ends up identical to whatever's
+// laid out directly after it -- the else arm -- and every jump aimed at
+// "after both arms" falls straight into the else arm's code instead.
+// Reverse postorder always lays a Block out after every arm that jumps
+// into it, so a trailing merge Block lands where it belongs: after both
+// arms, with nothing relying on its (possibly zero-width) region to be
+// anything but the end of the function.
+func (f *Func) ReversePostorder() []*Block {
+	seen := make(map[*Block]bool, len(f.Blocks))
+	var post []*Block
+	var visit func(b *Block)
+	visit = func(b *Block) {
+		if seen[b] {
+			return
+		}
+		seen[b] = true
+		for _, s := range b.Succs() {
+			visit(s)
+		}
+		post = append(post, b)
+	}
+	visit(f.Entry)
+	for i, j := 0, len(post)-1; i < j; i, j = i+1, j-1 {
+		post[i], post[j] = post[j], post[i]
+	}
+	return post
+}
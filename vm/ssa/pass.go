@@ -0,0 +1,27 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package ssa
+
+// Pass is one rewrite or analysis stage in a Pipeline.  Run mutates f in
+// place and reports whether it changed anything, so a Pipeline can decide
+// whether a later Pass needs to see a fresh LinkPreds call.
+type Pass interface {
+	Name() string
+	Run(f *Func) bool
+}
+
+// Pipeline is an ordered sequence of Passes, run once each over a Func.
+// CodeGen builds the default Pipeline for the compiler; tests can build
+// their own to exercise a single Pass in isolation.
+type Pipeline []Pass
+
+// Run executes every Pass in p over f in order, relinking predecessors
+// between passes since a Pass is free to rewrite Terms.
+func (p Pipeline) Run(f *Func) {
+	for _, pass := range p {
+		if pass.Run(f) {
+			f.LinkPreds()
+		}
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package ssa defines a small static single-assignment intermediate
+// representation used by the compiler in vm to sit between the AST and the
+// bytecode it emits.  A Func is a graph of Blocks, each ending in a single
+// Term that describes how control leaves the block; every Value inside a
+// Block is defined exactly once, which is what lets the passes in this
+// package (and the ones built on top of it) reason about the program without
+// having to replay the stack-machine's PC arithmetic.
+package ssa
+
+import "fmt"
+
+// Op identifies the operation a Value performs.  It is opaque to this
+// package: the compiler that builds a Func defines its own Op values (see
+// vm's codegen.go) and this package only ever compares them for equality,
+// so any comparable, stringable type works.
+type Op string
+
+// Value is a single SSA value: the result of applying Op to Args.  Passes
+// treat Values as immutable; rewriting a Value means replacing it wholesale
+// in Block.Values.  vm's codegen.go does change a Value's Aux in place
+// while it is still building the Func (a delete retags its load).
+type Value struct {
+	ID   int
+	Op   Op
+	Aux  interface{} // operation-specific constant data, e.g. an int operand
+	Args []*Value
+	Pos  int // source position, opaque to this package, used for diagnostics
+
+	Block *Block
+}
+
+func (v *Value) String() string {
+	return fmt.Sprintf("v%d = %s%v", v.ID, v.Op, v.Aux)
+}
+
+// TermKind distinguishes how a Block's Term hands control to the rest of
+// the Func.
+type TermKind int
+
+const (
+	// TermExit falls through to the next Block in layout order, or ends
+	// the Func if there is none.
+	TermExit TermKind = iota
+	// TermJump transfers control unconditionally to Then.
+	TermJump
+	// TermBranch transfers control to Then if Cond's result matched, or
+	// to Else otherwise.  Cond is normally the last Value in the Block
+	// (a match or cmp), kept here so passes can find the branch's
+	// dependency without scanning the Block backwards.
+	TermBranch
+)
+
+// Term is the terminator of a Block.
+type Term struct {
+	Kind TermKind
+	Cond *Value
+	Then *Block
+	Else *Block
+}
+
+// Block is a basic block: a straight-line run of Values ending in a Term.
+// Phis hold the merge points for values that differ depending on which
+// predecessor was taken. Nothing constructs one yet: vm's codegen.go still
+// threads the one value that genuinely differs by predecessor, condNode's
+// "matched" flag, through direct setmatched side-effecting Values rather
+// than a Phi, so this mechanism is scaffolding for later callers, not a
+// working feature.
+type Block struct {
+	ID     int
+	Name   string // human-readable, for dumps and tests
+	Func   *Func
+	Values []*Value
+	Phis   []*Phi
+	Term   Term
+
+	preds []*Block
+}
+
+// Phi is a merge of values flowing in from a Block's predecessors.  Edges
+// line up positionally with Block.Preds().
+type Phi struct {
+	ID    int
+	Block *Block
+	Edges []*Value
+}
+
+// Preds returns the blocks known to branch or fall through into b.  It is
+// only valid after Func.LinkPreds has been run.
+func (b *Block) Preds() []*Block { return b.preds }
+
+// Func is a compiled SSA function: the lowering of one mtail program.
+type Func struct {
+	Name   string
+	Blocks []*Block
+	Entry  *Block
+
+	numValues int
+	numBlocks int
+	numPhis   int
+}
+
+// NewFunc creates an empty Func with a single entry Block.
+func NewFunc(name string) *Func {
+	f := &Func{Name: name}
+	f.Entry = f.NewBlock("entry")
+	return f
+}
+
+// NewBlock appends a fresh, empty Block to f.
+func (f *Func) NewBlock(name string) *Block {
+	b := &Block{ID: f.numBlocks, Name: name, Func: f}
+	f.numBlocks++
+	f.Blocks = append(f.Blocks, b)
+	return b
+}
+
+// NewPhi appends a fresh Phi to b.
+func (b *Block) NewPhi() *Phi {
+	p := &Phi{ID: b.Func.numPhis, Block: b}
+	b.Func.numPhis++
+	b.Phis = append(b.Phis, p)
+	return p
+}
+
+// NewValue appends a Value computing op(args...) to b and returns it.
+//
+// Earlier revisions of this package deduplicated repeated "pure" ops
+// (identical op+aux+args) into a single shared Value, on the theory that a
+// stack machine backend could just re-push the same result.  It can't: the
+// lowering in vm's ssalower.go emits exactly one instr per Value it finds in
+// Block.Values, so a Value reached only through another Value's Args (the
+// second and later logical uses of a deduplicated op) got no instruction
+// emitted anywhere in the program, silently dropping a push.  That broke
+// every expression that uses a sub-expression twice, e.g. `x + x` or a
+// counter incremented on both arms of an if/else.  Until the lowering can
+// rematerialize a shared Value at every point it's consumed (e.g. by scoping
+// value numbering per-block and guarding it with a dominance check), every
+// call to NewValue builds a distinct instruction instead: this package
+// currently does not implement value numbering at all.
+func (b *Block) NewValue(op Op, aux interface{}, args ...*Value) *Value {
+	v := &Value{ID: b.Func.numValues, Op: op, Aux: aux, Args: args, Block: b}
+	b.Func.numValues++
+	b.Values = append(b.Values, v)
+	return v
+}
+
+// LinkPreds (re)computes every Block's predecessor list from the current
+// Term edges.  Passes that rewrite Terms must call this again before
+// relying on Preds().
+func (f *Func) LinkPreds() {
+	for _, b := range f.Blocks {
+		b.preds = nil
+	}
+	for _, b := range f.Blocks {
+		for _, s := range b.Succs() {
+			s.preds = append(s.preds, b)
+		}
+	}
+}
+
+// Succs returns the blocks b's Term can transfer control to, in layout
+// order (Then before Else).
+func (b *Block) Succs() []*Block {
+	switch b.Term.Kind {
+	case TermJump:
+		return []*Block{b.Term.Then}
+	case TermBranch:
+		return []*Block{b.Term.Then, b.Term.Else}
+	default:
+		return nil
+	}
+}
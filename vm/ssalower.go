@@ -0,0 +1,54 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import "github.com/google/mtail/vm/ssa"
+
+// lower walks c.f's Blocks -- already put in ReversePostorder by the
+// ssa.DeadBlocks pass DefaultPipeline always runs -- and appends the instr
+// each Value lowers to onto c.obj.prog, laying out jumps for each Block's
+// Term and patching their operands once every Block's start PC is known.
+// This is the one place PC arithmetic happens; the SSA builder itself
+// only ever deals in Block and Value references.  Relying on creation
+// order here instead would be wrong: codegen.go's condNode builds a
+// merge Block before the else Block, so a merge Block with no Values and
+// no explicit Term would alias its start PC with the else arm laid out
+// right after it, and any jump meant to land "after both arms" would
+// fall into the else arm's code instead.
+func (c *codegen) lower() {
+	type reloc struct {
+		idx    int
+		target *ssa.Block
+	}
+	var relocs []reloc
+	start := make(map[*ssa.Block]int, len(c.f.Blocks))
+
+	for _, b := range c.f.Blocks {
+		start[b] = len(c.obj.prog)
+		for _, v := range b.Values {
+			aux := v.Aux.(instrAux)
+			c.obj.prog = append(c.obj.prog, instr{aux.op, aux.opnd})
+		}
+		switch b.Term.Kind {
+		case ssa.TermJump:
+			relocs = append(relocs, reloc{len(c.obj.prog), b.Term.Then})
+			c.obj.prog = append(c.obj.prog, instr{op: jmp})
+
+		case ssa.TermBranch:
+			aux := b.Term.Cond.Aux.(instrAux)
+			mnemonic := jnm
+			if aux.invert {
+				mnemonic = jm
+			}
+			relocs = append(relocs, reloc{len(c.obj.prog), b.Term.Else})
+			c.obj.prog = append(c.obj.prog, instr{op: mnemonic})
+			relocs = append(relocs, reloc{len(c.obj.prog), b.Term.Then})
+			c.obj.prog = append(c.obj.prog, instr{op: jmp})
+		}
+	}
+
+	for _, r := range relocs {
+		c.obj.prog[r.idx].opnd = start[r.target]
+	}
+}